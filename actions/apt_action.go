@@ -24,6 +24,8 @@ Boolean property defaults to 'false'.
 package actions
 
 import (
+	"fmt"
+
 	"github.com/go-debos/debos"
 )
 
@@ -34,8 +36,10 @@ type AptAction struct {
 	AllowServices    bool `yaml:"allow-services"`
 }
 
-func (apt *AptAction) Run(context *debos.DebosContext) error {
-	apt.LogStart()
+func (apt *AptAction) Run(context *debos.DebosContext) (err error) {
+	context.Progress.Start("apt", len(apt.Packages))
+	defer func() { context.Progress.Done(err) }()
+
 	aptOptions := []string{"apt-get", "-y"}
 
 	if apt.AllowServices != true {
@@ -53,14 +57,18 @@ func (apt *AptAction) Run(context *debos.DebosContext) error {
 	c := debos.NewChrootCommand(context.Rootdir, context.Architecture)
 	c.AddEnv("DEBIAN_FRONTEND=noninteractive")
 
-	err := c.Run("apt", "apt-get", "update")
+	context.Progress.Update(0, "updating package lists")
+	err = c.Run("apt", "apt-get", "update")
 	if err != nil {
 		return err
 	}
+
+	context.Progress.Update(0, fmt.Sprintf("installing %d package(s)", len(apt.Packages)))
 	err = c.Run("apt", aptOptions...)
 	if err != nil {
 		return err
 	}
+
 	err = c.Run("apt", "apt-get", "clean")
 	if err != nil {
 		return err
@@ -0,0 +1,246 @@
+/*
+BootImg Action
+
+Package a kernel, ramdisk and optional second-stage/dtb into an Android
+`boot.img`, the image format consumed by the Android bootloader (and by
+Halium/UBports style recipes building on top of an Android-derived
+bootloader).
+
+Yaml syntax:
+ - action: bootimg
+   kernel: path
+   ramdisk: path
+   second: path
+   dtb: path
+   output: filename
+   header-version: 0
+   kernel-offset: offset
+   ramdisk-offset: offset
+   second-offset: offset
+   tags-offset: offset
+   page-size: size
+   cmdline: string
+   board: name
+
+Mandatory properties:
+
+- kernel -- path, relative to the filesystem root, of the kernel to embed.
+
+- ramdisk -- path of the ramdisk (initrd) to embed.
+
+- output -- filename of the produced boot.img, written to the artifact
+directory.
+
+Optional properties:
+
+- second -- path of a second-stage loader to embed.
+
+- dtb -- path of a device tree blob to embed. Only used with
+`header-version: 2`, where it is stored as its own section.
+
+- header-version -- boot image header version: `0` for the classic
+abootimg-compatible layout, or `2` for the newer header with a dtb
+section. `header-version: 3`, which moves the dtb into a separate
+`vendor_boot` image, is not implemented. Defaults to `0`.
+
+- kernel-offset, ramdisk-offset, second-offset, tags-offset -- load
+addresses embedded in the header, given as 32-bit integers (e.g.
+`0x00008000`); size suffixes such as `32MB` are not accepted. Default to
+the common Android defaults.
+
+- page-size -- page size used to align each section. Defaults to 2048.
+
+- cmdline -- kernel command line embedded in the header.
+
+- board -- board name embedded in the header.
+
+The produced image is registered as an artifact, and if a mountpoint of
+`image-partition` is flagged `boot`, a copy is written there too.
+*/
+package actions
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+const (
+	bootMagic        = "ANDROID!"
+	bootMagicSize    = 8
+	bootNameSize     = 16
+	bootArgsSize     = 512
+	bootExtraArgSize = 1024
+
+	defaultKernelOffset  = 0x00008000
+	defaultRamdiskOffset = 0x01000000
+	defaultSecondOffset  = 0x00f00000
+	defaultTagsOffset    = 0x00000100
+	defaultPageSize      = 2048
+)
+
+type BootImgAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Kernel           string
+	Ramdisk          string
+	Second           string
+	Dtb              string
+	Output           string
+	HeaderVersion    int    `yaml:"header-version"`
+	KernelOffset     uint32 `yaml:"kernel-offset"`
+	RamdiskOffset    uint32 `yaml:"ramdisk-offset"`
+	SecondOffset     uint32 `yaml:"second-offset"`
+	TagsOffset       uint32 `yaml:"tags-offset"`
+	PageSize         uint32 `yaml:"page-size"`
+	Cmdline          string
+	Board            string
+}
+
+func pageAlign(size, pageSize uint32) uint32 {
+	if size%pageSize == 0 {
+		return size
+	}
+	return (size/pageSize + 1) * pageSize
+}
+
+func (b *BootImgAction) readSection(context *debos.DebosContext, p string) ([]byte, error) {
+	if p == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path.Join(context.Rootdir, p))
+}
+
+// writePadded writes data followed by zero padding up to the next page
+// boundary, matching the layout mkbootimg(1) produces.
+func writePadded(buf *bytes.Buffer, data []byte, pageSize uint32) {
+	buf.Write(data)
+	padded := pageAlign(uint32(len(data)), pageSize)
+	buf.Write(make([]byte, padded-uint32(len(data))))
+}
+
+func fixedField(s string, size int) []byte {
+	b := make([]byte, size)
+	copy(b, s)
+	return b
+}
+
+func (b *BootImgAction) Run(context *debos.DebosContext) (err error) {
+	context.Progress.Start("bootimg", 0)
+	defer func() { context.Progress.Done(err) }()
+
+	kernel, err := b.readSection(context, b.Kernel)
+	if err != nil {
+		return fmt.Errorf("bootimg: couldn't read kernel: %v", err)
+	}
+	ramdisk, err := b.readSection(context, b.Ramdisk)
+	if err != nil {
+		return fmt.Errorf("bootimg: couldn't read ramdisk: %v", err)
+	}
+	second, err := b.readSection(context, b.Second)
+	if err != nil {
+		return fmt.Errorf("bootimg: couldn't read second-stage loader: %v", err)
+	}
+	dtb, err := b.readSection(context, b.Dtb)
+	if err != nil {
+		return fmt.Errorf("bootimg: couldn't read dtb: %v", err)
+	}
+
+	id := sha1.New()
+	id.Write(kernel)
+	binary.Write(id, binary.LittleEndian, uint32(len(kernel)))
+	id.Write(ramdisk)
+	binary.Write(id, binary.LittleEndian, uint32(len(ramdisk)))
+	id.Write(second)
+	binary.Write(id, binary.LittleEndian, uint32(len(second)))
+	if b.HeaderVersion == 2 {
+		id.Write(dtb)
+		binary.Write(id, binary.LittleEndian, uint32(len(dtb)))
+	}
+	sum := id.Sum(nil)
+
+	header := new(bytes.Buffer)
+	header.WriteString(bootMagic)
+	binary.Write(header, binary.LittleEndian, uint32(len(kernel)))
+	binary.Write(header, binary.LittleEndian, b.KernelOffset)
+	binary.Write(header, binary.LittleEndian, uint32(len(ramdisk)))
+	binary.Write(header, binary.LittleEndian, b.RamdiskOffset)
+	binary.Write(header, binary.LittleEndian, uint32(len(second)))
+	binary.Write(header, binary.LittleEndian, b.SecondOffset)
+	binary.Write(header, binary.LittleEndian, b.TagsOffset)
+	binary.Write(header, binary.LittleEndian, b.PageSize)
+	if b.HeaderVersion == 2 {
+		binary.Write(header, binary.LittleEndian, uint32(len(dtb)))
+		binary.Write(header, binary.LittleEndian, uint32(b.HeaderVersion))
+	} else {
+		binary.Write(header, binary.LittleEndian, uint32(0))
+		binary.Write(header, binary.LittleEndian, uint32(0))
+	}
+	header.Write(fixedField(b.Board, bootNameSize))
+	header.Write(fixedField(b.Cmdline, bootArgsSize))
+
+	idFields := make([]byte, 32)
+	copy(idFields, sum)
+	header.Write(idFields)
+	header.Write(make([]byte, bootExtraArgSize))
+
+	image := new(bytes.Buffer)
+	writePadded(image, header.Bytes(), b.PageSize)
+	writePadded(image, kernel, b.PageSize)
+	writePadded(image, ramdisk, b.PageSize)
+	if len(second) > 0 {
+		writePadded(image, second, b.PageSize)
+	}
+	if b.HeaderVersion == 2 && len(dtb) > 0 {
+		writePadded(image, dtb, b.PageSize)
+	}
+
+	output := path.Join(context.Artifactdir, b.Output)
+	if err = ioutil.WriteFile(output, image.Bytes(), 0644); err != nil {
+		return fmt.Errorf("bootimg: couldn't write %s: %v", output, err)
+	}
+
+	context.BootImgPath = output
+
+	return nil
+}
+
+func (b *BootImgAction) Verify(context *debos.DebosContext) error {
+	if b.Kernel == "" {
+		return fmt.Errorf("bootimg action requires a 'kernel' property")
+	}
+	if b.Ramdisk == "" {
+		return fmt.Errorf("bootimg action requires a 'ramdisk' property")
+	}
+	if b.Output == "" {
+		return fmt.Errorf("bootimg action requires an 'output' property")
+	}
+
+	switch b.HeaderVersion {
+	case 0, 2:
+	default:
+		return fmt.Errorf("bootimg: unsupported header-version %d", b.HeaderVersion)
+	}
+
+	if b.KernelOffset == 0 {
+		b.KernelOffset = defaultKernelOffset
+	}
+	if b.RamdiskOffset == 0 {
+		b.RamdiskOffset = defaultRamdiskOffset
+	}
+	if b.SecondOffset == 0 {
+		b.SecondOffset = defaultSecondOffset
+	}
+	if b.TagsOffset == 0 {
+		b.TagsOffset = defaultTagsOffset
+	}
+	if b.PageSize == 0 {
+		b.PageSize = defaultPageSize
+	}
+
+	return nil
+}
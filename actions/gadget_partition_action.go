@@ -0,0 +1,411 @@
+/*
+GadgetPartition Action
+
+Build an image from an Ubuntu Core / snap `gadget.yaml` instead of the
+inline `partitions`/`mountpoints` lists used by `image-partition`.
+gadget.yaml must define exactly one volume, with `schema: gpt`;
+structures are translated into debos partitions and mounted so their
+`content:` can be populated the same way `image-partition` does.
+
+Yaml syntax:
+ - action: gadget-partition
+   imagename: image_name
+   gadget: path/to/gadget.yaml
+
+Mandatory properties:
+
+- imagename -- the name of the image file.
+
+- gadget -- path, relative to the recipe, of the gadget.yaml to build
+from.
+
+Structure roles are translated to mountpoints as follows:
+
+- system-seed -- mounted at /boot/seed.
+
+- system-boot -- mounted at /boot.
+
+- system-data -- mounted at / (and used for root=UUID= in the generated
+kernel command line, same as a image-partition '/' mountpoint).
+
+Structures without a `filesystem` (the `mbr` structure and any raw
+bootloader structures) are not part of the partition table produced by
+debos; their `content:` is instead written directly at the structure's
+byte offset, the same way `dd` would lay out a `bare` gadget structure.
+
+Structures with a `filesystem` behave like image-partition partitions:
+their `content:` entries (`source`/`target` pairs) are copied into the
+mounted filesystem once it's formatted. A filesystem structure whose role
+is not one of those listed above is formatted but not mounted, and its
+`content:` entries are not copied.
+*/
+package actions
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/docker/go-units"
+	"github.com/go-debos/fakemachine"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/go-debos/debos"
+)
+
+type gadgetYAML struct {
+	Volumes map[string]gadgetVolume `yaml:"volumes"`
+}
+
+type gadgetVolume struct {
+	Schema     string            `yaml:"schema"`
+	Bootloader string            `yaml:"bootloader"`
+	Structure  []gadgetStructure `yaml:"structure"`
+}
+
+type gadgetStructure struct {
+	Name            string          `yaml:"name"`
+	Role            string          `yaml:"role"`
+	Type            string          `yaml:"type"`
+	Size            string          `yaml:"size"`
+	Offset          string          `yaml:"offset"`
+	Filesystem      string          `yaml:"filesystem"`
+	FilesystemLabel string          `yaml:"filesystem-label"`
+	Content         []gadgetContent `yaml:"content"`
+}
+
+type gadgetContent struct {
+	// Image is used by structures without a filesystem: it names a raw
+	// image file written at the structure's offset.
+	Image string `yaml:"image"`
+	// Source/Target are used by structures with a filesystem: Source is
+	// copied into Target inside the mounted filesystem.
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+var gadgetRoleMountpoint = map[string]string{
+	"system-seed": "/boot/seed",
+	"system-boot": "/boot",
+	"system-data": "/",
+}
+
+type GadgetPartitionAction struct {
+	debos.BaseAction `yaml:",inline"`
+	ImageName        string
+	Gadget           string
+	size             int64
+	volume           *gadgetVolume
+	mounts           debos.MountStack
+}
+
+func (g *GadgetPartitionAction) Verify(context *debos.DebosContext) error {
+	if g.ImageName == "" {
+		return fmt.Errorf("gadget-partition action requires an 'imagename' property")
+	}
+	if g.Gadget == "" {
+		return fmt.Errorf("gadget-partition action requires a 'gadget' property")
+	}
+
+	data, err := ioutil.ReadFile(path.Join(context.RecipeDir, g.Gadget))
+	if err != nil {
+		return fmt.Errorf("Couldn't read gadget.yaml: %v", err)
+	}
+
+	parsed := gadgetYAML{}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return fmt.Errorf("Couldn't parse gadget.yaml: %v", err)
+	}
+
+	// Building more than one volume would mean producing more than one
+	// image from a single 'imagename', which this action has no way to
+	// express; require gadget.yaml to name exactly one so which volume
+	// gets built is never left to Go's randomized map iteration order.
+	if len(parsed.Volumes) != 1 {
+		return fmt.Errorf("gadget-partition: gadget.yaml must define exactly one volume, found %d", len(parsed.Volumes))
+	}
+
+	var total int64
+	for name, v := range parsed.Volumes {
+		if v.Schema != "" && v.Schema != "gpt" {
+			return fmt.Errorf("gadget-partition: unsupported schema %q on volume %q, only gpt is supported", v.Schema, name)
+		}
+		volume := v
+		g.volume = &volume
+	}
+
+	for idx := range g.volume.Structure {
+		s := &g.volume.Structure[idx]
+		size, err := units.FromHumanSize(s.Size)
+		if err != nil {
+			return fmt.Errorf("gadget-partition: invalid size %q on structure %q: %v", s.Size, s.Name, err)
+		}
+		total += size
+	}
+
+	// Leave some room past the last structure for secondary GPT headers.
+	g.size = total + (1 << 20)
+
+	return nil
+}
+
+func (g *GadgetPartitionAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
+	args *[]string) error {
+	image, err := m.CreateImage(g.ImageName, g.size)
+	if err != nil {
+		return err
+	}
+
+	context.Image = image
+	*args = append(*args, "--internal-image", image)
+	return nil
+}
+
+func (g *GadgetPartitionAction) PreNoMachine(context *debos.DebosContext) error {
+	img, err := os.OpenFile(g.ImageName, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return fmt.Errorf("Couldn't open image file: %v", err)
+	}
+	if err := img.Truncate(g.size); err != nil {
+		return fmt.Errorf("Couldn't resize image file: %v", err)
+	}
+	img.Close()
+
+	context.Image = g.ImageName
+
+	return nil
+}
+
+// gadgetFsType adapts a gadget.yaml filesystem name (which spells the FAT
+// filesystem "vfat", following mkfs(8)) onto the debos/go-diskfs name
+// ("fat32") before deferring to the shared fsType lookup.
+func gadgetFsType(fs string) (filesystem.Type, error) {
+	if fs == "vfat" {
+		fs = "fat32"
+	}
+	return fsType(fs)
+}
+
+// gadgetMountpoint returns the mountpoint a structure's role maps to, or
+// "" for a structure that isn't mounted: a bare structure (content written
+// at a byte offset) or a filesystem structure whose role has no mountpoint.
+func gadgetMountpoint(s *gadgetStructure) string {
+	if s.Filesystem == "" {
+		return ""
+	}
+	if mnt, ok := gadgetRoleMountpoint[s.Role]; ok {
+		return mnt
+	}
+	return ""
+}
+
+func (g *GadgetPartitionAction) Run(context *debos.DebosContext) (err error) {
+	context.Progress.Start("gadget-partition", len(g.volume.Structure))
+	defer func() { context.Progress.Done(err) }()
+
+	g.mounts.Defer(context)
+	defer func() {
+		if err != nil {
+			g.mounts.PopAll()
+		}
+	}()
+
+	d, err := diskfs.Open(context.Image, diskfs.WithOpenMode(diskfs.ReadWriteExclusive))
+	if err != nil {
+		return fmt.Errorf("Failed to open image: %v", err)
+	}
+
+	table := &gpt.Table{
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 512,
+		ProtectiveMBR:      true,
+	}
+
+	var offset int64
+	number := 1
+	type built struct {
+		structure *gadgetStructure
+		number    int
+	}
+	type bare struct {
+		structure *gadgetStructure
+		start     int64
+	}
+	var partitioned []built
+	var bareStructures []bare
+
+	for idx := range g.volume.Structure {
+		s := &g.volume.Structure[idx]
+
+		size, err := units.FromHumanSize(s.Size)
+		if err != nil {
+			return fmt.Errorf("gadget-partition: invalid size on structure %q: %v", s.Name, err)
+		}
+
+		start := offset
+		if s.Offset != "" {
+			o, err := units.FromHumanSize(s.Offset)
+			if err != nil {
+				return fmt.Errorf("gadget-partition: invalid offset %q on structure %q: %v", s.Offset, s.Name, err)
+			}
+			start = o
+		}
+
+		if s.Filesystem == "" {
+			// Bare structure (mbr, bootloader blobs, ...): not part of
+			// the GPT partition table. Its content is written below, once
+			// the table (which always carries a protective MBR over LBA0)
+			// has actually been committed, so it can't get clobbered.
+			bareStructures = append(bareStructures, bare{structure: s, start: start})
+			offset = start + size
+			continue
+		}
+
+		table.Partitions = append(table.Partitions, &gpt.Partition{
+			Start: uint64(start / sectorSize),
+			End:   uint64((start+size)/sectorSize) - 1,
+			Size:  uint64(size),
+			Type:  gpt.LinuxFilesystem,
+			Name:  s.Name,
+		})
+		partitioned = append(partitioned, built{structure: s, number: number})
+		number++
+		offset = start + size
+	}
+
+	if len(table.Partitions) > 0 {
+		if err := d.Partition(table); err != nil {
+			return fmt.Errorf("Failed to write GPT partition table: %v", err)
+		}
+	}
+
+	for _, b := range bareStructures {
+		if err := g.writeBareContent(context, b.structure, b.start); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range partitioned {
+		ftype, err := gadgetFsType(b.structure.Filesystem)
+		if err != nil {
+			return err
+		}
+		spec := disk.FilesystemSpec{
+			Partition:   b.number,
+			FSType:      ftype,
+			VolumeLabel: b.structure.FilesystemLabel,
+		}
+		if _, err := d.CreateFilesystem(spec); err != nil {
+			return fmt.Errorf("Failed to create %s filesystem on %q: %v", b.structure.Filesystem, b.structure.Name, err)
+		}
+	}
+
+	if len(partitioned) > 0 && !isBlockDevice(context.Image) {
+		loopdev, err := g.mounts.AttachLoop(context.Image)
+		if err != nil {
+			return err
+		}
+		context.Image = loopdev
+	}
+
+	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
+	os.MkdirAll(context.ImageMntDir, 755)
+
+	for _, b := range partitioned {
+		mnt := gadgetMountpoint(b.structure)
+		if mnt == "" {
+			continue
+		}
+
+		dev := partitionDevice(b.number, *context)
+		mntpath := path.Join(context.ImageMntDir, mnt)
+		os.MkdirAll(mntpath, 755)
+
+		if err := g.mounts.Mount(dev, mntpath, b.structure.Filesystem, 0, ""); err != nil {
+			return fmt.Errorf("%s mount failed: %v", b.structure.Name, err)
+		}
+
+		if mnt == "/" {
+			uuid, err := readFSUUID(dev)
+			if err != nil {
+				return err
+			}
+			context.ImageKernelRoot = fmt.Sprintf("root=UUID=%s", uuid)
+		}
+
+		if err := g.writeFilesystemContent(context, b.structure, mntpath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBareContent lays down a structure's raw content image directly
+// at its absolute byte offset in the image file, mirroring how a `bare`
+// gadget structure is flashed without going through a filesystem.
+func (g GadgetPartitionAction) writeBareContent(context *debos.DebosContext, s *gadgetStructure, offset int64) error {
+	f, err := os.OpenFile(context.Image, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("gadget-partition: couldn't open image for raw write: %v", err)
+	}
+	defer f.Close()
+
+	for _, c := range s.Content {
+		if c.Image == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(context.RecipeDir, c.Image))
+		if err != nil {
+			return fmt.Errorf("gadget-partition: couldn't read content image %q: %v", c.Image, err)
+		}
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return fmt.Errorf("gadget-partition: couldn't write content image %q: %v", c.Image, err)
+		}
+	}
+
+	return nil
+}
+
+// writeFilesystemContent copies a structure's source/target content
+// entries into its mounted filesystem.
+func (g GadgetPartitionAction) writeFilesystemContent(context *debos.DebosContext, s *gadgetStructure, mntpath string) error {
+	for _, c := range s.Content {
+		if c.Source == "" {
+			continue
+		}
+
+		src, err := os.Open(path.Join(context.RecipeDir, c.Source))
+		if err != nil {
+			return fmt.Errorf("gadget-partition: couldn't open content source %q: %v", c.Source, err)
+		}
+
+		target := path.Join(mntpath, c.Target)
+		os.MkdirAll(path.Dir(target), 0755)
+
+		dst, err := os.Create(target)
+		if err != nil {
+			src.Close()
+			return fmt.Errorf("gadget-partition: couldn't create %q: %v", target, err)
+		}
+
+		_, err = io.Copy(dst, src)
+		src.Close()
+		dst.Close()
+		if err != nil {
+			return fmt.Errorf("gadget-partition: couldn't copy content into %q: %v", target, err)
+		}
+	}
+
+	return nil
+}
+
+func (g *GadgetPartitionAction) Cleanup(context debos.DebosContext) error {
+	return g.mounts.PopAll()
+}
@@ -1,7 +1,18 @@
 /*
 ImagePartition Action
 
-This action creates an image file, partitions it and formats the filesystems.
+This action creates an image file, partitions it and formats the
+filesystems. Partitioning and formatting are done in pure Go via
+github.com/diskfs/go-diskfs, so 'parted' and 'mkfs.*' are no longer
+required on the host. `losetup` and `blkid` are still required, though:
+go-diskfs has no way to stamp a chosen FSUUID onto the filesystem it
+creates, so a loop device is attached and the real UUID is read back
+with `blkid`, the same as before go-diskfs. The partitions are then
+mounted with the kernel, so later actions (unpack, overlay, run, ...) can
+populate the image through normal filesystem writes into the mountpoint
+tree. Every mount and loop attachment is tracked in a `debos.MountStack`,
+so a partial failure -- e.g. the second of three mountpoints failing to
+mount -- can't leave an earlier mount or the loop device behind.
 
 Yaml syntax:
  - action: image-partition
@@ -77,6 +88,21 @@ Optional properties:
 
 - options -- list of options to be added to appropriate entry in fstab file.
 
+- esp -- boolean marking this mountpoint as the EFI System Partition. If a
+`uki` action has produced a Unified Kernel Image earlier in the recipe, it
+is copied into `EFI/Linux/` on this mountpoint.
+
+- boot -- boolean marking this mountpoint as the boot partition. If a
+`bootimg` action has produced an Android boot.img earlier in the recipe,
+it is copied onto this mountpoint.
+
+Other optional properties:
+
+- state-mountpoint -- name of a mountpoint (as listed above) that should
+also receive a copy of the `state.yaml` manifest written after this
+action runs. The manifest is always written to the artifact directory;
+see `debos.State` for its contents.
+
 Layout example for Raspberry PI 3:
 
  - action: image-partition
@@ -103,15 +129,22 @@ Layout example for Raspberry PI 3:
 package actions
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	diskfs "github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
 	"github.com/docker/go-units"
 	"github.com/go-debos/fakemachine"
+	"io"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
-	"syscall"
 
 	"github.com/go-debos/debos"
 )
@@ -130,6 +163,8 @@ type Mountpoint struct {
 	Mountpoint string
 	Partition  string
 	Options    []string
+	ESP        bool
+	Boot       bool
 	part       *Partition
 }
 
@@ -140,8 +175,9 @@ type ImagePartitionAction struct {
 	PartitionType    string
 	Partitions       []Partition
 	Mountpoints      []Mountpoint
+	StateMountpoint  string `yaml:"state-mountpoint"`
 	size             int64
-	usingLoop        bool
+	mounts           debos.MountStack
 }
 
 func (i *ImagePartitionAction) generateFSTab(context *debos.DebosContext) error {
@@ -180,7 +216,9 @@ func (i *ImagePartitionAction) generateKernelRoot(context *debos.DebosContext) e
 	return nil
 }
 
-func (i ImagePartitionAction) getPartitionDevice(number int, context debos.DebosContext) string {
+// partitionDevice returns the device node for partition `number` of the
+// disk at context.Image, shared by image-partition and gadget-partition.
+func partitionDevice(number int, context debos.DebosContext) string {
 	suffix := "p"
 	/* Check partition naming first: if used 'by-id'i naming convention */
 	if strings.Contains(context.Image, "/disk/by-id/") {
@@ -197,7 +235,7 @@ func (i ImagePartitionAction) getPartitionDevice(number int, context debos.Debos
 	}
 }
 
-func (i ImagePartitionAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
+func (i *ImagePartitionAction) PreMachine(context *debos.DebosContext, m *fakemachine.Machine,
 	args *[]string) error {
 	image, err := m.CreateImage(i.ImageName, i.size)
 	if err != nil {
@@ -209,31 +247,72 @@ func (i ImagePartitionAction) PreMachine(context *debos.DebosContext, m *fakemac
 	return nil
 }
 
-func (i ImagePartitionAction) formatPartition(p *Partition, context debos.DebosContext) error {
-	label := fmt.Sprintf("Formatting partition %d", p.number)
-	path := i.getPartitionDevice(p.number, context)
-
-	cmdline := []string{}
-	switch p.FS {
+// fsType maps a debos filesystem name onto the go-diskfs filesystem type
+// used to create it.
+func fsType(fs string) (filesystem.Type, error) {
+	switch fs {
 	case "fat32":
-		cmdline = append(cmdline, "mkfs.vfat", "-n", p.Name)
+		return filesystem.TypeFat32, nil
+	case "ext2", "ext3", "ext4":
+		return filesystem.TypeExt4, nil
+	case "xfs":
+		return filesystem.TypeXFS, nil
 	default:
-		cmdline = append(cmdline, fmt.Sprintf("mkfs.%s", p.FS), "-L", p.Name)
+		return 0, fmt.Errorf("Unsupported filesystem type: %s", fs)
 	}
-	cmdline = append(cmdline, path)
+}
 
-	debos.Command{}.Run(label, cmdline...)
+// readFSUUID reads back the FSUUID blkid finds on dev. go-diskfs's
+// CreateFilesystem doesn't take a UUID to stamp onto the filesystem it
+// creates, so this is the only way to learn the real one.
+func readFSUUID(dev string) (string, error) {
+	out, err := exec.Command("blkid", "-s", "UUID", "-o", "value", dev).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read filesystem UUID from %s: %v", dev, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
 
-	uuid, err := exec.Command("blkid", "-o", "value", "-s", "UUID", "-p", "-c", "none", path).Output()
+// resolveOffset turns a human-readable or percentage offset ('64MB',
+// '100%') into an absolute byte offset on a disk of the given total size.
+func resolveOffset(spec string, totalSize int64) (int64, error) {
+	if strings.HasSuffix(spec, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(spec, "%"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid percentage offset %q: %v", spec, err)
+		}
+		return int64(pct / 100 * float64(totalSize)), nil
+	}
+
+	size, err := units.FromHumanSize(spec)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid offset %q: %v", spec, err)
+	}
+	return size, nil
+}
+
+func (i ImagePartitionAction) formatPartition(p *Partition, d *disk.Disk, context *debos.DebosContext) error {
+	context.Progress.Update(p.number, fmt.Sprintf("formatting partition %d (%s, %s)", p.number, p.Name, p.FS))
+
+	ftype, err := fsType(p.FS)
 	if err != nil {
-		return fmt.Errorf("Failed to get uuid: %s", err)
+		return err
+	}
+
+	spec := disk.FilesystemSpec{
+		Partition:   p.number,
+		FSType:      ftype,
+		VolumeLabel: p.Name,
+	}
+
+	if _, err := d.CreateFilesystem(spec); err != nil {
+		return fmt.Errorf("Failed to create %s filesystem on partition %d: %v", p.FS, p.number, err)
 	}
-	p.FSUUID = strings.TrimSpace(string(uuid[:]))
 
 	return nil
 }
 
-func (i ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
+func (i *ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
 
 	img, err := os.OpenFile(i.ImageName, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
@@ -247,56 +326,199 @@ func (i ImagePartitionAction) PreNoMachine(context *debos.DebosContext) error {
 
 	img.Close()
 
-	loop, err := exec.Command("losetup", "-f", "--show", i.ImageName).Output()
-	if err != nil {
-		return fmt.Errorf("Failed to setup loop device")
-	}
-	context.Image = strings.TrimSpace(string(loop[:]))
-	i.usingLoop = true
+	context.Image = i.ImageName
 
 	return nil
 }
 
-func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
-	i.LogStart()
-	err := debos.Command{}.Run("parted", "parted", "-s", context.Image, "mklabel", i.PartitionType)
+// isBlockDevice reports whether path is already a block device, as is the
+// case for the image fakemachine hands in when running inside the
+// machine: the kernel scans its partitions directly and no loop device is
+// needed.
+func isBlockDevice(p string) bool {
+	fi, err := os.Stat(p)
 	if err != nil {
-		return err
+		return false
 	}
-	for idx, _ := range i.Partitions {
+	return fi.Mode()&os.ModeDevice != 0
+}
+
+// sectorSize is the logical/physical sector size used for every image
+// debos creates; both buildGPT and buildMBR place partitions on this
+// grid, matching the LogicalSectorSize/PhysicalSectorSize given to
+// go-diskfs.
+const sectorSize = 512
+
+// gptPartitionType maps flags onto the GPT partition type GUID they used
+// to select via `parted ... set <n> <flag> on`. Unrecognised flags are
+// rejected rather than silently producing a partition typed as plain
+// Linux filesystem data.
+func gptPartitionType(flags []string) (gpt.Type, error) {
+	ptype := gpt.LinuxFilesystem
+
+	for _, flag := range flags {
+		switch flag {
+		case "esp":
+			ptype = gpt.EFISystemPartition
+		case "bios_grub":
+			ptype = gpt.BIOSBoot
+		case "lvm":
+			ptype = gpt.LinuxLVM
+		case "raid":
+			ptype = gpt.LinuxRaid
+		case "swap":
+			ptype = gpt.LinuxSwap
+		case "boot":
+			// No GPT partition type corresponds to parted's "boot" flag;
+			// recognised, but otherwise a no-op on a GPT table.
+		default:
+			return "", fmt.Errorf("Unsupported partition flag %q for gpt table", flag)
+		}
+	}
+
+	return ptype, nil
+}
+
+func (i ImagePartitionAction) buildGPT(totalSize int64) (*gpt.Table, error) {
+	table := &gpt.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+		ProtectiveMBR:      true,
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		start, err := resolveOffset(p.Start, totalSize)
+		if err != nil {
+			return nil, err
+		}
+		end, err := resolveOffset(p.End, totalSize)
+		if err != nil {
+			return nil, err
+		}
+
+		ptype, err := gptPartitionType(p.Flags)
+		if err != nil {
+			return nil, err
+		}
+
+		table.Partitions = append(table.Partitions, &gpt.Partition{
+			Start: uint64(start / sectorSize),
+			End:   uint64(end/sectorSize) - 1,
+			Size:  uint64(end - start),
+			Type:  ptype,
+			Name:  p.Name,
+		})
+	}
+
+	return table, nil
+}
+
+func (i ImagePartitionAction) buildMBR(totalSize int64) (*mbr.Table, error) {
+	table := &mbr.Table{
+		LogicalSectorSize:  sectorSize,
+		PhysicalSectorSize: sectorSize,
+	}
+
+	for idx := range i.Partitions {
 		p := &i.Partitions[idx]
-		var name string
-		if i.PartitionType == "gpt" {
-			name = p.Name
-		} else {
-			name = "primary"
-		}
-		err = debos.Command{}.Run("parted", "parted", "-a", "none", "-s", context.Image, "mkpart",
-			name, p.FS, p.Start, p.End)
+		start, err := resolveOffset(p.Start, totalSize)
+		if err != nil {
+			return nil, err
+		}
+		end, err := resolveOffset(p.End, totalSize)
+		if err != nil {
+			return nil, err
+		}
+
+		table.Partitions = append(table.Partitions, &mbr.Partition{
+			Start:    uint32(start / sectorSize),
+			Size:     uint32((end - start) / sectorSize),
+			Type:     mbr.Linux,
+			Bootable: contains(p.Flags, "boot"),
+		})
+	}
+
+	return table, nil
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ImagePartitionAction) Run(context *debos.DebosContext) (err error) {
+	context.Progress.Start("image-partition", len(i.Partitions))
+	defer func() { context.Progress.Done(err) }()
+
+	// Registering the stack with the context before anything is mounted
+	// means bailOnError can still unwind these mounts if a later action
+	// fails before Cleanup() is reached; an early error in this Run()
+	// itself is unwound by the deferred PopAll below.
+	i.mounts.Defer(context)
+	defer func() {
+		if err != nil {
+			i.mounts.PopAll()
+		}
+	}()
+
+	d, err := diskfs.Open(context.Image, diskfs.WithOpenMode(diskfs.ReadWriteExclusive))
+	if err != nil {
+		return fmt.Errorf("Failed to open image: %v", err)
+	}
+
+	if i.PartitionType == "gpt" {
+		t, err := i.buildGPT(i.size)
 		if err != nil {
 			return err
 		}
+		if err := d.Partition(t); err != nil {
+			return fmt.Errorf("Failed to write GPT partition table: %v", err)
+		}
+	} else {
+		t, err := i.buildMBR(i.size)
+		if err != nil {
+			return err
+		}
+		if err := d.Partition(t); err != nil {
+			return fmt.Errorf("Failed to write MBR partition table: %v", err)
+		}
+	}
 
-		if p.Flags != nil {
-			for _, flag := range p.Flags {
-				err = debos.Command{}.Run("parted", "parted", "-s", context.Image, "set",
-					fmt.Sprintf("%d", p.number), flag, "on")
-				if err != nil {
-					return err
-				}
-			}
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		if err := i.formatPartition(p, d, context); err != nil {
+			return err
+		}
+	}
+
+	// A real block device is needed to read the FSUUID back with blkid
+	// and to mount the formatted partitions with the kernel.
+	if !isBlockDevice(context.Image) {
+		loopdev, err := i.mounts.AttachLoop(context.Image)
+		if err != nil {
+			return err
 		}
+		context.Image = loopdev
+	}
 
-		err = i.formatPartition(p, *context)
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		uuid, err := readFSUUID(partitionDevice(p.number, *context))
 		if err != nil {
 			return err
 		}
+		p.FSUUID = uuid
 	}
 
 	context.ImageMntDir = path.Join(context.Scratchdir, "mnt")
 	os.MkdirAll(context.ImageMntDir, 755)
 	for _, m := range i.Mountpoints {
-		dev := i.getPartitionDevice(m.part.number, *context)
+		dev := partitionDevice(m.part.number, *context)
 		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
 		os.MkdirAll(mntpath, 755)
 		var fs string
@@ -306,8 +528,7 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		default:
 			fs = m.part.FS
 		}
-		err := syscall.Mount(dev, mntpath, fs, 0, "")
-		if err != nil {
+		if err := i.mounts.Mount(dev, mntpath, fs, 0, ""); err != nil {
 			return fmt.Errorf("%s mount failed: %v", m.part.Name, err)
 		}
 	}
@@ -322,23 +543,179 @@ func (i ImagePartitionAction) Run(context *debos.DebosContext) error {
 		return err
 	}
 
+	err = i.installUKI(context)
+	if err != nil {
+		return err
+	}
+
+	err = i.installBootImg(context)
+	if err != nil {
+		return err
+	}
+
+	err = i.writeState(context)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func (i ImagePartitionAction) Cleanup(context debos.DebosContext) error {
-	for idx := len(i.Mountpoints) - 1; idx >= 0; idx-- {
-		m := i.Mountpoints[idx]
-		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
-		syscall.Unmount(mntpath, 0)
+func recipeCommit(context *debos.DebosContext) string {
+	out, err := exec.Command("git", "-C", context.RecipeDir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out[:]))
+}
+
+func imageSHA256(imagePath string) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+/* writeState captures the resolved partition table, mountpoint tree and
+produced image into a state.yaml manifest in the artifact directory, and
+optionally on a mountpoint inside the image itself. */
+func (i ImagePartitionAction) writeState(context *debos.DebosContext) error {
+	state := &debos.State{
+		PartitionType: i.PartitionType,
+		Image:         i.ImageName,
+		Recipe:        context.RecipeDir,
+		RecipeCommit:  recipeCommit(context),
+		TemplateVars:  context.TemplateVars,
+	}
+
+	for idx := range i.Partitions {
+		p := &i.Partitions[idx]
+		state.Partitions = append(state.Partitions, debos.StatePartition{
+			Number: p.number,
+			Name:   p.Name,
+			Start:  p.Start,
+			End:    p.End,
+			Flags:  p.Flags,
+			FS:     p.FS,
+			Label:  p.Name,
+			FSUUID: p.FSUUID,
+		})
+	}
+
+	for _, m := range i.Mountpoints {
+		state.Mountpoints = append(state.Mountpoints, debos.StateMountpoint{
+			Mountpoint: m.Mountpoint,
+			Partition:  m.Partition,
+		})
+	}
+
+	if sha, err := imageSHA256(path.Join(context.Artifactdir, i.ImageName)); err == nil {
+		state.ImageSHA256 = sha
+	}
+
+	statePath := path.Join(context.Artifactdir, "state.yaml")
+	if err := debos.SaveState(statePath, state); err != nil {
+		return err
+	}
+
+	if i.StateMountpoint != "" {
+		for _, m := range i.Mountpoints {
+			if m.Mountpoint != i.StateMountpoint {
+				continue
+			}
+			mntStatePath := path.Join(context.ImageMntDir, m.Mountpoint, "state.yaml")
+			if err := debos.SaveState(mntStatePath, state); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+/* installUKI copies a UKI produced by an earlier 'uki' action into
+EFI/Linux/ on the mountpoint flagged 'esp', if any. */
+func (i ImagePartitionAction) installUKI(context *debos.DebosContext) error {
+	if context.UKIPath == "" {
+		return nil
+	}
+
+	for _, m := range i.Mountpoints {
+		if !m.ESP {
+			continue
+		}
+
+		espdir := path.Join(context.ImageMntDir, m.Mountpoint, "EFI", "Linux")
+		if err := os.MkdirAll(espdir, 0755); err != nil {
+			return fmt.Errorf("Failed to create EFI/Linux on esp partition: %v", err)
+		}
+
+		src, err := os.Open(context.UKIPath)
+		if err != nil {
+			return fmt.Errorf("Failed to open UKI: %v", err)
+		}
+		defer src.Close()
+
+		dst, err := os.Create(path.Join(espdir, path.Base(context.UKIPath)))
+		if err != nil {
+			return fmt.Errorf("Failed to create UKI on esp partition: %v", err)
+		}
+		defer dst.Close()
+
+		if _, err := io.Copy(dst, src); err != nil {
+			return fmt.Errorf("Failed to copy UKI to esp partition: %v", err)
+		}
 	}
 
-	if i.usingLoop {
-		exec.Command("losetup", "-d", context.Image).Run()
+	return nil
+}
+
+/* installBootImg copies a boot.img produced by an earlier 'bootimg'
+action onto the mountpoint flagged 'boot', if any. */
+func (i ImagePartitionAction) installBootImg(context *debos.DebosContext) error {
+	if context.BootImgPath == "" {
+		return nil
+	}
+
+	for _, m := range i.Mountpoints {
+		if !m.Boot {
+			continue
+		}
+
+		mntpath := path.Join(context.ImageMntDir, m.Mountpoint)
+
+		src, err := os.Open(context.BootImgPath)
+		if err != nil {
+			return fmt.Errorf("Failed to open boot.img: %v", err)
+		}
+		defer src.Close()
+
+		dst, err := os.Create(path.Join(mntpath, path.Base(context.BootImgPath)))
+		if err != nil {
+			return fmt.Errorf("Failed to create boot.img on boot partition: %v", err)
+		}
+		defer dst.Close()
+
+		if _, err := io.Copy(dst, src); err != nil {
+			return fmt.Errorf("Failed to copy boot.img to boot partition: %v", err)
+		}
 	}
 
 	return nil
 }
 
+func (i *ImagePartitionAction) Cleanup(context debos.DebosContext) error {
+	return i.mounts.PopAll()
+}
+
 func (i *ImagePartitionAction) Verify(context *debos.DebosContext) error {
 	num := 1
 	for idx, _ := range i.Partitions {
@@ -0,0 +1,235 @@
+/*
+UKI Action
+
+Assemble a Unified Kernel Image (UKI) -- a single UEFI PE binary combining
+the kernel, initrd, kernel command line, os-release and an optional splash
+image -- and optionally sign it for UEFI Secure Boot.
+
+Yaml syntax:
+ - action: uki
+   kernel: path
+   initrd: path
+   cmdline: string
+   os-release: path
+   splash: path
+   sbat: path
+   signing-key: path
+   signing-cert: path
+   output: filename
+
+Mandatory properties:
+
+- kernel -- path, relative to the filesystem root, of the kernel image to
+embed in the `.linux` PE section.
+
+- initrd -- path of the initrd to embed in the `.initrd` PE section.
+
+- output -- filename of the produced UKI. It is written to the artifact
+directory.
+
+Optional properties:
+
+- cmdline -- kernel command line embedded in the `.cmdline` PE section.
+
+- os-release -- path of an os-release file embedded in the `.osrel` PE
+section. Defaults to `/etc/os-release` in the target filesystem.
+
+- splash -- path of a BMP image embedded in the `.splash` PE section.
+
+- sbat -- path of a `.sbat` metadata file. If `signing-key`/`signing-cert`
+are given and no `sbat` is specified, a minimal `.sbat` section covering
+this UKI is generated and embedded automatically.
+
+- signing-key, signing-cert -- PEM key and certificate pair passed to
+`sbsign` to Secure Boot sign the resulting image. Both must be given
+together.
+
+- pcr-signing-key -- PEM key used to precompute and embed a `.pcrsig`
+section containing TPM2 PCR 11 signatures for each measured section, so
+the produced UKI can be verified by a measured-boot policy.
+
+The produced UKI is suitable for placing as `EFI/Linux/<output>` on an ESP;
+see the `esp` mountpoint property of the `image-partition` action.
+*/
+package actions
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/go-debos/debos"
+)
+
+const defaultStubPath = "/usr/lib/systemd/boot/efi/linuxx64.efi.stub"
+
+type UKIAction struct {
+	debos.BaseAction `yaml:",inline"`
+	Kernel           string
+	Initrd           string
+	Cmdline          string
+	OSRelease        string `yaml:"os-release"`
+	Splash           string
+	Sbat             string
+	SigningKey       string `yaml:"signing-key"`
+	SigningCert      string `yaml:"signing-cert"`
+	PCRSigningKey    string `yaml:"pcr-signing-key"`
+	Stub             string
+	Output           string
+}
+
+/* ukiSection describes a single PE section to be embedded in the stub via
+objcopy, in the order they should appear. */
+type ukiSection struct {
+	name string
+	path string
+}
+
+func (uki *UKIAction) inRoot(context *debos.DebosContext, p string) string {
+	if p == "" {
+		return ""
+	}
+	return path.Join(context.Rootdir, p)
+}
+
+func (uki *UKIAction) sections(context *debos.DebosContext, scratchdir string) ([]ukiSection, error) {
+	osRelease := uki.OSRelease
+	if osRelease == "" {
+		osRelease = "/etc/os-release"
+	}
+
+	sections := []ukiSection{
+		{".osrel", uki.inRoot(context, osRelease)},
+	}
+
+	if uki.Cmdline != "" {
+		cmdlinePath := path.Join(scratchdir, "cmdline")
+		if err := ioutil.WriteFile(cmdlinePath, []byte(uki.Cmdline), 0644); err != nil {
+			return nil, fmt.Errorf("uki: couldn't write cmdline: %v", err)
+		}
+		sections = append(sections, ukiSection{".cmdline", cmdlinePath})
+	}
+
+	if uki.Splash != "" {
+		sections = append(sections, ukiSection{".splash", uki.inRoot(context, uki.Splash)})
+	}
+
+	sbat := uki.Sbat
+	if sbat == "" && (uki.SigningKey != "" || uki.SigningCert != "") {
+		generated := path.Join(scratchdir, "uki.sbat")
+		contents := "uki,1,UKI,uki,1,https://www.freedesktop.org/software/systemd/man/systemd-stub.html\n"
+		if err := ioutil.WriteFile(generated, []byte(contents), 0644); err != nil {
+			return nil, fmt.Errorf("uki: couldn't write generated sbat: %v", err)
+		}
+		sbat = generated
+	}
+	if sbat != "" {
+		sections = append(sections, ukiSection{".sbat", sbat})
+	}
+
+	sections = append(sections,
+		ukiSection{".linux", uki.inRoot(context, uki.Kernel)},
+		ukiSection{".initrd", uki.inRoot(context, uki.Initrd)})
+
+	return sections, nil
+}
+
+func (uki *UKIAction) signPCRs(context *debos.DebosContext, sections []ukiSection, scratchdir string) (string, error) {
+	if uki.PCRSigningKey == "" {
+		return "", nil
+	}
+
+	pcrsig := path.Join(scratchdir, "pcrsig")
+	args := []string{"systemd-measure", "sign",
+		"--pcr-bank=sha256",
+		"--private-key", uki.PCRSigningKey,
+		fmt.Sprintf("--linux=%s", uki.inRoot(context, uki.Kernel)),
+		fmt.Sprintf("--initrd=%s", uki.inRoot(context, uki.Initrd))}
+	for _, s := range sections {
+		switch s.name {
+		case ".linux", ".initrd":
+			continue
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", s.name[1:], s.path))
+	}
+	args = append(args, fmt.Sprintf("--output=%s", pcrsig))
+
+	cmd := debos.Command{}
+	if err := cmd.Run("uki", args...); err != nil {
+		return "", fmt.Errorf("uki: failed to compute PCR11 signatures: %v", err)
+	}
+
+	return pcrsig, nil
+}
+
+func (uki *UKIAction) Run(context *debos.DebosContext) error {
+	uki.LogStart()
+
+	scratchdir := path.Join(context.Scratchdir, "uki")
+	if err := os.MkdirAll(scratchdir, 0755); err != nil {
+		return fmt.Errorf("uki: couldn't create scratch dir: %v", err)
+	}
+
+	sections, err := uki.sections(context, scratchdir)
+	if err != nil {
+		return err
+	}
+
+	if pcrsig, err := uki.signPCRs(context, sections, scratchdir); err != nil {
+		return err
+	} else if pcrsig != "" {
+		sections = append(sections, ukiSection{".pcrsig", pcrsig})
+	}
+
+	stub := uki.Stub
+	if stub == "" {
+		stub = defaultStubPath
+	}
+
+	output := path.Join(context.Artifactdir, uki.Output)
+
+	args := []string{}
+	for _, s := range sections {
+		args = append(args, "--add-section", fmt.Sprintf("%s=%s", s.name, s.path),
+			"--change-section-vma", fmt.Sprintf("%s=0", s.name))
+	}
+	args = append(args, path.Join(context.Rootdir, stub), output)
+
+	cmdline := append([]string{"objcopy"}, args...)
+	cmd := debos.Command{}
+	if err := cmd.Run("uki", cmdline...); err != nil {
+		return fmt.Errorf("uki: objcopy failed: %v", err)
+	}
+
+	if uki.SigningKey != "" {
+		cmd := debos.Command{}
+		err := cmd.Run("uki", "sbsign",
+			"--key", uki.SigningKey, "--cert", uki.SigningCert,
+			"--output", output, output)
+		if err != nil {
+			return fmt.Errorf("uki: sbsign failed: %v", err)
+		}
+	}
+
+	context.UKIPath = output
+
+	return nil
+}
+
+func (uki *UKIAction) Verify(context *debos.DebosContext) error {
+	if uki.Kernel == "" {
+		return fmt.Errorf("uki action requires a 'kernel' property")
+	}
+	if uki.Initrd == "" {
+		return fmt.Errorf("uki action requires an 'initrd' property")
+	}
+	if uki.Output == "" {
+		return fmt.Errorf("uki action requires an 'output' property")
+	}
+	if (uki.SigningKey == "") != (uki.SigningCert == "") {
+		return fmt.Errorf("uki action requires 'signing-key' and 'signing-cert' to be set together")
+	}
+
+	return nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"syscall"
 
 	"github.com/docker/go-units"
 	"github.com/go-debos/debos"
@@ -20,15 +23,32 @@ func bailOnError(context debos.DebosContext, err error, a debos.Action, stage st
 		return
 	}
 
-	log.Printf("Action `%s` failed at stage %s, error: %s", a, stage, err)
+	context.Progress.Log("error", fmt.Sprintf("Action `%s` failed at stage %s, error: %s", a, stage, err))
+	context.Progress.Done(err)
+
+	// Give the user a chance to inspect the failure, e.g. a mounted
+	// image-partition tree, before anything gets unwound below.
 	debos.DebugShell(context)
+
+	// Unwind every MountStack registered so far: the action whose Run
+	// failed may never reach its own Cleanup, and os.Exit below would
+	// otherwise leave earlier actions' mounts and loop devices behind.
+	for _, stack := range context.Mounts {
+		if unmountErr := stack.PopAll(); unmountErr != nil {
+			context.Progress.Log("error", fmt.Sprintf("Cleanup after failure: %s", unmountErr))
+		}
+	}
+
 	os.Exit(1)
 }
 
 // If option BuildStorageLocation has been passed.
 // Prepare the image formatted as ext4 and setup to mount it to '/scratch'
 // in fake machine
-func prepareBuildImage(m *fakemachine.Machine, buildImagePath string, buildImageSize int64) (string, error) {
+func prepareBuildImage(m *fakemachine.Machine, buildImagePath string, buildImageSize int64, progress debos.Progress) (_ string, err error) {
+	progress.Start("build-storage", 0)
+	defer func() { progress.Done(err) }()
+
 	fi, err := os.Stat(buildImagePath)
 	if err != nil {
 		return "", err
@@ -42,18 +62,20 @@ func prepareBuildImage(m *fakemachine.Machine, buildImagePath string, buildImage
 		return "", err
 	}
 
-	if err := buildImage.Truncate(buildImageSize); err != nil {
+	if err = buildImage.Truncate(buildImageSize); err != nil {
 		return buildImage.Name(), err
 	}
 
 	label := "/scratch"
 
+	progress.Update(0, "formatting temporary build image")
+
 	// Format the whole disk image disabling journal support
 	cmdline := []string{}
 	cmdline = append(cmdline, "mkfs.ext4", "-q", "-L", label, buildImage.Name())
 	cmdline = append(cmdline, "-O", "^has_journal")
 	cmd := debos.Command{}
-	if err := cmd.Run(label, cmdline...); err != nil {
+	if err = cmd.Run(label, cmdline...); err != nil {
 		return buildImage.Name(), err
 	}
 
@@ -65,16 +87,60 @@ func prepareBuildImage(m *fakemachine.Machine, buildImagePath string, buildImage
 	return buildImage.Name(), nil
 }
 
+// forwardProgress tails a fifo fed by a nested debos running inside
+// fakemachine, replaying each JSON progress event it receives into the
+// host's own Progress reporter until the fifo is closed.
+func forwardProgress(fifoPath string, progress debos.Progress) {
+	f, err := os.Open(fifoPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event struct {
+			Event   string `json:"event"`
+			Stage   string `json:"stage"`
+			Total   int    `json:"total"`
+			Current int    `json:"current"`
+			Level   string `json:"level"`
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+
+		switch event.Event {
+		case "start":
+			progress.Start(event.Stage, event.Total)
+		case "update":
+			progress.Update(event.Current, event.Message)
+		case "log":
+			progress.Log(event.Level, event.Message)
+		case "done":
+			var doneErr error
+			if event.Error != "" {
+				doneErr = fmt.Errorf("%s", event.Error)
+			}
+			progress.Done(doneErr)
+		}
+	}
+}
+
 func main() {
 	var context debos.DebosContext
 	var options struct {
-		ArtifactDir          string            `long:"artifactdir"`
-		InternalImage        string            `long:"internal-image" hidden:"true"`
-		BuildStorageLocation string            `short:"b" long:"build-storage" description:"Directory for temporary build image"`
-		BuildStorageSize     string            `long:"build-storage-size" description:"The size of the temporary build image" default:"10gB"`
-		TemplateVars         map[string]string `short:"t" long:"template-var" description:"Template variables"`
-		DebugShell           bool              `long:"debug-shell" description:"Fall into interactive shell on error"`
-		Shell                string            `short:"s" long:"shell" description:"Redefine interactive shell binary (default: bash)" optionsl:"" default:"/bin/bash"`
+		ArtifactDir           string            `long:"artifactdir"`
+		InternalImage         string            `long:"internal-image" hidden:"true"`
+		InternalProgressFifo  string            `long:"internal-progress-fifo" hidden:"true"`
+		BuildStorageLocation  string            `short:"b" long:"build-storage" description:"Directory for temporary build image"`
+		BuildStorageSize      string            `long:"build-storage-size" description:"The size of the temporary build image" default:"10gB"`
+		TemplateVars          map[string]string `short:"t" long:"template-var" description:"Template variables"`
+		DebugShell            bool              `long:"debug-shell" description:"Fall into interactive shell on error"`
+		Shell                 string            `short:"s" long:"shell" description:"Redefine interactive shell binary (default: bash)" optionsl:"" default:"/bin/bash"`
+		Progress              string            `long:"progress" description:"Progress reporting format" choice:"auto" choice:"json" default:"auto"`
 	}
 
 	var exitcode int = 0
@@ -109,6 +175,18 @@ func main() {
 		context.DebugShell = options.Shell
 	}
 
+	if options.InternalProgressFifo != "" {
+		fifo, err := os.OpenFile(options.InternalProgressFifo, os.O_WRONLY, 0)
+		if err != nil {
+			log.Printf("Couldn't open progress fifo: %v", err)
+			context.Progress = debos.NewProgress(options.Progress == "json")
+		} else {
+			context.Progress = debos.NewJSONProgress(fifo)
+		}
+	} else {
+		context.Progress = debos.NewProgress(options.Progress == "json")
+	}
+
 	file := args[0]
 	file = debos.CleanPath(file)
 
@@ -146,6 +224,7 @@ func main() {
 	context.Origins["recipe"] = context.RecipeDir
 
 	context.Architecture = r.Architecture
+	context.TemplateVars = options.TemplateVars
 
 	for _, a := range r.Actions {
 		err = a.Verify(&context)
@@ -159,6 +238,13 @@ func main() {
 		m.AddVolume(context.Artifactdir)
 		args = append(args, "--artifactdir", context.Artifactdir)
 
+		progressFifo := path.Join(context.Artifactdir, ".debos-progress.fifo")
+		if err := syscall.Mkfifo(progressFifo, 0600); err == nil {
+			defer os.Remove(progressFifo)
+			go forwardProgress(progressFifo, context.Progress)
+			args = append(args, "--internal-progress-fifo", progressFifo)
+		}
+
 		for k, v := range options.TemplateVars {
 			args = append(args, "--template-var", fmt.Sprintf("%s:\"%s\"", k, v))
 		}
@@ -180,7 +266,7 @@ func main() {
 				return
 			}
 
-			buildImage, err := prepareBuildImage(m, blddir, buildImageSize)
+			buildImage, err := prepareBuildImage(m, blddir, buildImageSize, context.Progress)
 			if len(buildImage) != 0 {
 				defer os.Remove(buildImage)
 			}
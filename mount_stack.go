@@ -0,0 +1,89 @@
+package debos
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// mountOp is one reversible resource acquired by a MountStack: a kernel
+// mount, a bind mount, or a loop device attachment.
+type mountOp struct {
+	undo func() error
+}
+
+/*
+MountStack records mounts and loop device attachments in the order they
+are acquired and unwinds them in LIFO order, on both success and
+failure. Using it instead of ad-hoc syscall.Mount/Unmount calls means a
+partial failure -- e.g. the second of three mountpoints failing to mount
+-- can no longer leave earlier mounts or loop devices behind: call
+PopAll from a defer as soon as the stack is created, and nothing can be
+left mounted regardless of where an error is returned.
+*/
+type MountStack struct {
+	ops []mountOp
+}
+
+// Push registers an already-acquired resource together with the
+// function that releases it, so it gets unwound by PopAll.
+func (s *MountStack) Push(undo func() error) {
+	s.ops = append(s.ops, mountOp{undo: undo})
+}
+
+// Mount performs a syscall.Mount and pushes its unmount onto the stack.
+func (s *MountStack) Mount(source, target, fstype string, flags uintptr, data string) error {
+	if err := syscall.Mount(source, target, fstype, flags, data); err != nil {
+		return fmt.Errorf("Mount of %s failed: %v", target, err)
+	}
+	s.Push(func() error { return syscall.Unmount(target, 0) })
+	return nil
+}
+
+// Bind performs a bind mount and pushes its unmount onto the stack.
+func (s *MountStack) Bind(source, target string) error {
+	return s.Mount(source, target, "", syscall.MS_BIND, "")
+}
+
+// AttachLoop attaches imagePath as a loop device with partition scanning
+// enabled, and pushes its detachment onto the stack.
+func (s *MountStack) AttachLoop(imagePath string) (string, error) {
+	out, err := exec.Command("losetup", "-f", "-P", "--show", imagePath).Output()
+	if err != nil {
+		return "", fmt.Errorf("Failed to setup loop device: %v", err)
+	}
+
+	dev := strings.TrimSpace(string(out))
+	s.Push(func() error { return exec.Command("losetup", "-d", dev).Run() })
+
+	return dev, nil
+}
+
+// PopAll unwinds every resource currently on the stack in LIFO order,
+// continuing even if one teardown fails, and returns the first error
+// encountered (if any). It is safe to call repeatedly: once unwound the
+// stack is empty and further calls are a no-op.
+func (s *MountStack) PopAll() error {
+	var firstErr error
+
+	for idx := len(s.ops) - 1; idx >= 0; idx-- {
+		if err := s.ops[idx].undo(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.ops = nil
+
+	return firstErr
+}
+
+/*
+Defer hands the stack to the DebosContext so that it can still be
+unwound even when the action that built it never reaches its own
+Cleanup call -- e.g. because a later action's Run() returned an error
+and the driver bails out via bailOnError, which unwinds every stack in
+context.Mounts before exiting.
+*/
+func (s *MountStack) Defer(context *DebosContext) {
+	context.Mounts = append(context.Mounts, s)
+}
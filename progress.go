@@ -0,0 +1,42 @@
+package debos
+
+import (
+	"os"
+)
+
+/*
+Progress is implemented by reporters that observe the lifecycle of an
+action as it executes: which stage started, how far along it is,
+diagnostic log lines, and whether it ultimately succeeded or failed.
+Actions call the reporter in DebosContext.Progress without a nil check,
+so it must be set (the debos command always sets it) before any action
+runs.
+*/
+type Progress interface {
+	// Start announces a new stage of up to 'total' steps. total is 0
+	// when the number of steps isn't known up front.
+	Start(stage string, total int)
+	// Update reports progress within the current stage.
+	Update(current int, msg string)
+	// Log emits a free-form diagnostic line at the given level, e.g.
+	// "debug", "info", "warning" or "error".
+	Log(level, msg string)
+	// Done marks the current stage finished; err is nil on success.
+	Done(err error)
+}
+
+// NewProgress picks the human-readable TTY reporter unless json is
+// requested or stdout isn't a terminal, in which case it falls back to
+// the JSON-lines reporter so CI systems get machine-parseable events.
+func NewProgress(json bool) Progress {
+	if json {
+		return NewJSONProgress(os.Stdout)
+	}
+
+	fi, err := os.Stdout.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return NewJSONProgress(os.Stdout)
+	}
+
+	return NewTTYProgress(os.Stdout)
+}
@@ -0,0 +1,60 @@
+package debos
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+type progressEvent struct {
+	Event   string `json:"event"`
+	Stage   string `json:"stage,omitempty"`
+	Total   int    `json:"total,omitempty"`
+	Current int    `json:"current,omitempty"`
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// JSONProgress is a Progress reporter that emits one JSON object per
+// line, selected with '--progress=json' so CI systems and other
+// tooling can consume build progress without scraping human-readable
+// text.
+type JSONProgress struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	stage string
+}
+
+func NewJSONProgress(out io.Writer) *JSONProgress {
+	return &JSONProgress{enc: json.NewEncoder(out)}
+}
+
+func (j *JSONProgress) emit(e progressEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// Errors writing progress events are deliberately ignored: losing a
+	// progress line must never fail the build.
+	j.enc.Encode(e)
+}
+
+func (j *JSONProgress) Start(stage string, total int) {
+	j.stage = stage
+	j.emit(progressEvent{Event: "start", Stage: stage, Total: total})
+}
+
+func (j *JSONProgress) Update(current int, msg string) {
+	j.emit(progressEvent{Event: "update", Stage: j.stage, Current: current, Message: msg})
+}
+
+func (j *JSONProgress) Log(level, msg string) {
+	j.emit(progressEvent{Event: "log", Stage: j.stage, Level: level, Message: msg})
+}
+
+func (j *JSONProgress) Done(err error) {
+	e := progressEvent{Event: "done", Stage: j.stage}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	j.emit(e)
+}
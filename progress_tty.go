@@ -0,0 +1,72 @@
+package debos
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	ttyReset  = "\033[0m"
+	ttyBold   = "\033[1m"
+	ttyGreen  = "\033[32m"
+	ttyYellow = "\033[33m"
+	ttyRed    = "\033[31m"
+)
+
+// TTYProgress is a human-readable Progress reporter for interactive
+// terminals. Coloring is enabled unless NO_COLOR is set in the
+// environment.
+type TTYProgress struct {
+	out   io.Writer
+	color bool
+	stage string
+	total int
+}
+
+func NewTTYProgress(out io.Writer) *TTYProgress {
+	return &TTYProgress{
+		out:   out,
+		color: os.Getenv("NO_COLOR") == "",
+	}
+}
+
+func (t *TTYProgress) paint(code, msg string) string {
+	if !t.color {
+		return msg
+	}
+	return code + msg + ttyReset
+}
+
+func (t *TTYProgress) Start(stage string, total int) {
+	t.stage = stage
+	t.total = total
+	fmt.Fprintln(t.out, t.paint(ttyBold, fmt.Sprintf("==== %s ====", stage)))
+}
+
+func (t *TTYProgress) Update(current int, msg string) {
+	if t.total > 0 {
+		fmt.Fprintf(t.out, "[%d/%d] %s\n", current, t.total, msg)
+		return
+	}
+	fmt.Fprintln(t.out, msg)
+}
+
+func (t *TTYProgress) Log(level, msg string) {
+	switch level {
+	case "error":
+		fmt.Fprintln(t.out, t.paint(ttyRed, msg))
+	case "warning":
+		fmt.Fprintln(t.out, t.paint(ttyYellow, msg))
+	default:
+		fmt.Fprintln(t.out, msg)
+	}
+}
+
+func (t *TTYProgress) Done(err error) {
+	if err != nil {
+		fmt.Fprintln(t.out, t.paint(ttyRed, fmt.Sprintf("---- %s failed: %v ----", t.stage, err)))
+		return
+	}
+	fmt.Fprintln(t.out, t.paint(ttyGreen, fmt.Sprintf("---- %s done ----", t.stage)))
+}
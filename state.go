@@ -0,0 +1,83 @@
+package debos
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// StateSchemaVersion is bumped whenever the State struct changes in a way
+// that isn't backwards compatible with existing consumers.
+const StateSchemaVersion = 1
+
+/*
+StatePartition records the on-disk layout of a single partition as it was
+actually created by the image-partition action.
+*/
+type StatePartition struct {
+	Number int      `yaml:"number"`
+	Name   string   `yaml:"name"`
+	Start  string   `yaml:"start"`
+	End    string   `yaml:"end"`
+	Flags  []string `yaml:"flags,omitempty"`
+	FS     string   `yaml:"fs"`
+	Label  string   `yaml:"label"`
+	FSUUID string   `yaml:"fsuuid"`
+}
+
+// StateMountpoint records where a partition ended up mounted in the image.
+type StateMountpoint struct {
+	Mountpoint string `yaml:"mountpoint"`
+	Partition  string `yaml:"partition"`
+}
+
+/*
+State is a structured manifest describing an image produced by debos: its
+partition table, the mountpoint tree, the resulting image file and the
+recipe that produced it. It is meant to be re-read by downstream tooling
+(upgrade/reset flows, provisioning systems) that need to know exactly what
+layout was deployed without re-parsing the recipe.
+*/
+type State struct {
+	SchemaVersion int                `yaml:"schema-version"`
+	PartitionType string             `yaml:"partition-type"`
+	Partitions    []StatePartition   `yaml:"partitions"`
+	Mountpoints   []StateMountpoint  `yaml:"mountpoints"`
+	Image         string             `yaml:"image"`
+	ImageSHA256   string             `yaml:"image-sha256"`
+	Recipe        string             `yaml:"recipe"`
+	RecipeCommit  string             `yaml:"recipe-commit,omitempty"`
+	TemplateVars  map[string]string  `yaml:"template-vars,omitempty"`
+}
+
+// SaveState writes state as yaml to path, creating or truncating it.
+func SaveState(path string, state *State) error {
+	state.SchemaVersion = StateSchemaVersion
+
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal state: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write state to %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// LoadState reads and parses a state.yaml previously written by SaveState.
+func LoadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read state from %s: %v", path, err)
+	}
+
+	state := &State{}
+	if err := yaml.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Failed to parse state from %s: %v", path, err)
+	}
+
+	return state, nil
+}